@@ -0,0 +1,77 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/base32"
+	"fmt"
+
+	crypto "github.com/libp2p/go-libp2p-crypto"
+	peer "github.com/libp2p/go-libp2p-peer"
+)
+
+// signedFields is the canonical, order-stable encoding of the hello fields
+// the sender signs and the receiver verifies. It deliberately excludes
+// ProtocolVersion: that can legitimately differ between retries without
+// invalidating the sender's identity claim.
+func signedFields(h *hello) []byte {
+	return []byte(fmt.Sprintf("%s|%s|%s|%d|%s", h.Name, h.Hostname, h.File, h.Size, h.FileHash))
+}
+
+// signHello signs h's signedFields with priv and fills in PubKey/Signature.
+func signHello(priv crypto.PrivKey, h *hello) error {
+	pub, err := priv.GetPublic().Bytes()
+	if err != nil {
+		return err
+	}
+
+	sig, err := priv.Sign(signedFields(h))
+	if err != nil {
+		return err
+	}
+
+	h.PubKey = pub
+	h.Signature = sig
+	return nil
+}
+
+// verifyHello checks that h.Signature is a valid signature by h.PubKey over
+// h's signed fields. Callers should also cross-check the recovered peer ID
+// against the libp2p connection's remote peer so a signature can't be
+// replayed from a different identity than the one we're connected to.
+func verifyHello(h *hello) error {
+	pub, err := crypto.UnmarshalPublicKey(h.PubKey)
+	if err != nil {
+		return fmt.Errorf("unmarshalling sender pubkey: %s", err)
+	}
+
+	ok, err := pub.Verify(signedFields(h), h.Signature)
+	if err != nil {
+		return fmt.Errorf("verifying hello signature: %s", err)
+	}
+	if !ok {
+		return fmt.Errorf("hello signature does not match sender pubkey")
+	}
+
+	return nil
+}
+
+// peerIDFromHello derives the peer ID that h.PubKey corresponds to. For
+// transports like pubsub broadcast, where we aren't necessarily directly
+// connected to the sender, this is how a receiver learns who actually
+// signed a hello rather than trusting transport-layer routing metadata.
+func peerIDFromHello(h *hello) (peer.ID, error) {
+	pub, err := crypto.UnmarshalPublicKey(h.PubKey)
+	if err != nil {
+		return "", err
+	}
+	return peer.IDFromPublicKey(pub)
+}
+
+// safetyNumber is a short, human-comparable fingerprint of a peer's
+// identity key: the first 8 bytes of SHA-256(pubkey), base32-encoded. Two
+// users can read this out loud or compare it over a side channel to catch
+// a MITM that the libp2p transport encryption alone wouldn't surface.
+func safetyNumber(pubKeyBytes []byte) string {
+	sum := sha256.Sum256(pubKeyBytes)
+	return base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(sum[:8])
+}
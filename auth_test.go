@@ -0,0 +1,80 @@
+package main
+
+import (
+	"testing"
+
+	crypto "github.com/libp2p/go-libp2p-crypto"
+	peer "github.com/libp2p/go-libp2p-peer"
+)
+
+func TestSignHelloVerifyRoundtrip(t *testing.T) {
+	priv, _, err := crypto.GenerateEd25519Key(nil)
+	if err != nil {
+		t.Fatalf("generating key: %s", err)
+	}
+
+	h := &hello{Name: "alice", Hostname: "alice-box", File: "report.pdf", Size: 1234, FileHash: "deadbeef"}
+	if err := signHello(priv, h); err != nil {
+		t.Fatalf("signHello: %s", err)
+	}
+
+	if err := verifyHello(h); err != nil {
+		t.Fatalf("verifyHello on a freshly signed hello: %s", err)
+	}
+
+	id, err := peerIDFromHello(h)
+	if err != nil {
+		t.Fatalf("peerIDFromHello: %s", err)
+	}
+
+	wantID, err := peer.IDFromPrivateKey(priv)
+	if err != nil {
+		t.Fatalf("IDFromPrivateKey: %s", err)
+	}
+	if id != wantID {
+		t.Errorf("peerIDFromHello = %s, want %s", id, wantID)
+	}
+}
+
+func TestVerifyHelloRejectsTamperedField(t *testing.T) {
+	priv, _, err := crypto.GenerateEd25519Key(nil)
+	if err != nil {
+		t.Fatalf("generating key: %s", err)
+	}
+
+	h := &hello{Name: "alice", Hostname: "alice-box", File: "report.pdf", Size: 1234, FileHash: "deadbeef"}
+	if err := signHello(priv, h); err != nil {
+		t.Fatalf("signHello: %s", err)
+	}
+
+	h.Size = 9999
+	if err := verifyHello(h); err == nil {
+		t.Error("verifyHello accepted a hello whose signed field was changed after signing")
+	}
+}
+
+func TestVerifyHelloRejectsWrongSigner(t *testing.T) {
+	priv, _, err := crypto.GenerateEd25519Key(nil)
+	if err != nil {
+		t.Fatalf("generating key: %s", err)
+	}
+	otherPriv, _, err := crypto.GenerateEd25519Key(nil)
+	if err != nil {
+		t.Fatalf("generating key: %s", err)
+	}
+
+	h := &hello{Name: "alice", Hostname: "alice-box", File: "report.pdf", Size: 1234, FileHash: "deadbeef"}
+	if err := signHello(priv, h); err != nil {
+		t.Fatalf("signHello: %s", err)
+	}
+
+	otherPub, err := otherPriv.GetPublic().Bytes()
+	if err != nil {
+		t.Fatalf("marshalling other pubkey: %s", err)
+	}
+	h.PubKey = otherPub
+
+	if err := verifyHello(h); err == nil {
+		t.Error("verifyHello accepted a signature against the wrong pubkey")
+	}
+}
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/user"
+	"strconv"
+	"sync"
+	"time"
+
+	human "github.com/dustin/go-humanize"
+	peer "github.com/libp2p/go-libp2p-peer"
+	pstore "github.com/libp2p/go-libp2p-peerstore"
+	pubsub "github.com/libp2p/go-libp2p-pubsub"
+	bhost "github.com/libp2p/go-libp2p/p2p/host/basic"
+	ma "github.com/multiformats/go-multiaddr"
+	ui "github.com/whyrusleeping/gooey"
+)
+
+// broadcastTopic is the gossipsub topic a room name maps to. Sender and
+// receivers only need to agree on the room name; unlike the mdns/DHT paths
+// they don't need a direct connection to discover each other, just a
+// common pubsub mesh (i.e. at least one shared bootstrap/relay peer).
+func broadcastTopic(room string) string {
+	return "p2pdrop/room/" + room
+}
+
+// broadcastAdvertise publishes myhello to room every interval until ctx is
+// cancelled. The receiver side of this is broadcastListen.
+func broadcastAdvertise(ctx context.Context, h *bhost.BasicHost, room string, myhello hello, app *ui.App) error {
+	ps, err := pubsub.NewGossipSub(ctx, h)
+	if err != nil {
+		return err
+	}
+
+	topic, err := ps.Join(broadcastTopic(room))
+	if err != nil {
+		return err
+	}
+
+	raw, err := json.Marshal(myhello)
+	if err != nil {
+		return err
+	}
+
+	for {
+		if err := topic.Publish(ctx, raw); err != nil {
+			app.Log.Add(fmt.Sprintf("broadcast publish: %s", err))
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(time.Second * 10):
+		}
+	}
+}
+
+// broadcastListen subscribes to room and calls onHello once per distinct
+// sender peer ID, after checking that each hello's signature matches the
+// pubkey it claims. It also pins the sender's advertised addrs in the
+// peerstore so the caller can dial it without mDNS or the DHT.
+func broadcastListen(ctx context.Context, h *bhost.BasicHost, room string, onHello func(hello)) error {
+	ps, err := pubsub.NewGossipSub(ctx, h)
+	if err != nil {
+		return err
+	}
+
+	topic, err := ps.Join(broadcastTopic(room))
+	if err != nil {
+		return err
+	}
+
+	sub, err := topic.Subscribe()
+	if err != nil {
+		return err
+	}
+
+	var seenLk sync.Mutex
+	seen := map[peer.ID]bool{}
+
+	for {
+		msg, err := sub.Next(ctx)
+		if err != nil {
+			return err
+		}
+
+		var hl hello
+		if err := json.Unmarshal(msg.GetData(), &hl); err != nil {
+			continue
+		}
+
+		if err := verifyHello(&hl); err != nil {
+			continue
+		}
+
+		senderID, err := peerIDFromHello(&hl)
+		if err != nil || senderID == h.ID() {
+			continue
+		}
+		hl.peer = senderID
+
+		seenLk.Lock()
+		dup := seen[hl.peer]
+		seen[hl.peer] = true
+		seenLk.Unlock()
+		if dup {
+			continue
+		}
+
+		for _, raw := range hl.Addrs {
+			if maddr, err := ma.NewMultiaddr(raw); err == nil {
+				h.Peerstore().AddAddr(hl.peer, maddr, pstore.TempAddrTTL)
+			}
+		}
+
+		onHello(hl)
+	}
+}
+
+// runBroadcastSender serves paths to anyone subscribed to room, the same
+// way sendCommand does for mDNS/DHT peers, but advertises itself over
+// gossipsub instead of pushing a hello to each new connection.
+func runBroadcastSender(ctx context.Context, h *bhost.BasicHost, room string, paths []string, password string, app *ui.App) error {
+	dm, lookup, err := buildDirManifest(paths)
+	if err != nil {
+		return err
+	}
+
+	registerManifestHandler(h, dm, app)
+	registerChunkedGetHandler(h, newChunkManifestCache(lookup), password, app)
+
+	name, err := os.Hostname()
+	if err != nil {
+		return err
+	}
+
+	u, err := user.Current()
+	if err != nil {
+		return err
+	}
+
+	var selfAddrs []string
+	for _, a := range h.Addrs() {
+		selfAddrs = append(selfAddrs, a.String())
+	}
+
+	myhello := hello{
+		Name:            u.Username,
+		Hostname:        name,
+		File:            describeTransfer(paths, dm),
+		Size:            dm.TotalSize,
+		FileHash:        dm.aggregateHash(),
+		Addrs:           selfAddrs,
+		ProtocolVersion: "2.0.0",
+	}
+
+	if err := signHello(h.Peerstore().PrivKey(h.ID()), &myhello); err != nil {
+		return err
+	}
+	app.Log.Add(fmt.Sprintf("broadcasting %s in room %q, safety number: %s", myhello.File, room, safetyNumber(myhello.PubKey)))
+
+	return broadcastAdvertise(ctx, h, room, myhello, app)
+}
+
+// runBroadcastReceiver lists distinct senders it sees in room and, once the
+// user picks one by number, fetches every entry in that sender's manifest
+// the same way recvCommand does.
+func runBroadcastReceiver(ctx context.Context, h *bhost.BasicHost, room string, password string, app *ui.App) error {
+	var sendersLk sync.Mutex
+	var senders []hello
+
+	listenErr := make(chan error, 1)
+	go func() {
+		listenErr <- broadcastListen(ctx, h, room, func(hl hello) {
+			sendersLk.Lock()
+			n := len(senders)
+			senders = append(senders, hl)
+			sendersLk.Unlock()
+
+			app.Log.Add(fmt.Sprintf("%d: %s@%s - %s (%s) [safety number: %s]", n, hl.Name, hl.Hostname, hl.File, human.Bytes(hl.Size), safetyNumber(hl.PubKey)))
+		})
+	}()
+
+	app.NewDataLine(13, "Select sender by number:", "")
+	app.NewDataLine(2, "-------", "")
+
+	scan := bufio.NewScanner(os.Stdin)
+	for scan.Scan() {
+		select {
+		case err := <-listenErr:
+			return err
+		default:
+		}
+
+		n, err := strconv.Atoi(scan.Text())
+		if err != nil {
+			app.Log.Add(fmt.Sprintf("input error: %s", err))
+			continue
+		}
+
+		sendersLk.Lock()
+		hl := senders[n]
+		sendersLk.Unlock()
+
+		dm, err := fetchManifest(ctx, h, hl.peer)
+		if err != nil {
+			fmt.Println("fetch manifest err: ", err)
+			break
+		}
+
+		if dm.aggregateHash() != hl.FileHash {
+			fmt.Println("fetch err: manifest hash does not match the hash signed in the sender's hello")
+			break
+		}
+
+		failed := false
+		for _, entry := range dm.Entries {
+			outPath, err := safeJoin(".", entry.RelPath)
+			if err != nil {
+				fmt.Println("fetch err: ", err)
+				failed = true
+				break
+			}
+			fmt.Printf("fetching %s (%s)\n", entry.RelPath, human.Bytes(entry.Size))
+			if err := fetchChunked(ctx, h, hl.peer, entry.RelPath, outPath, password, app); err != nil {
+				fmt.Println("fetch err: ", err)
+				failed = true
+				break
+			}
+			if err := os.Chmod(outPath, entry.Mode); err != nil {
+				app.Log.Add(fmt.Sprintf("chmod %s: %s", outPath, err))
+			}
+		}
+		if !failed {
+			fmt.Println("Success!")
+		}
+		break
+	}
+
+	return nil
+}
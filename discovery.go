@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	discovery "github.com/libp2p/go-libp2p-discovery"
+	dht "github.com/libp2p/go-libp2p-kad-dht"
+	inet "github.com/libp2p/go-libp2p-net"
+	pstore "github.com/libp2p/go-libp2p-peerstore"
+	bhost "github.com/libp2p/go-libp2p/p2p/host/basic"
+	ma "github.com/multiformats/go-multiaddr"
+	ui "github.com/whyrusleeping/gooey"
+)
+
+// defaultBootstrapPeers are the public libp2p/IPFS bootstrap nodes used to
+// join the DHT before we have any rendezvous-specific peers to dial.
+var defaultBootstrapPeers = []string{
+	"/dnsaddr/bootstrap.libp2p.io/p2p/QmNnooDu7bfjPFoTZYxMNLWUQJyrVwtbZg5gBMjTezGAJN",
+	"/dnsaddr/bootstrap.libp2p.io/p2p/QmQCU2EcMqAqQPR2i9bChDtGNJchTbq5TbXJJ16u19uLTa",
+	"/dnsaddr/bootstrap.libp2p.io/p2p/QmbLHAnMoJPWSCR5Zhtx6BHJX9KiKNN6tpvbUcqanj75Nb",
+	"/dnsaddr/bootstrap.libp2p.io/p2p/QmcZf59bWwK5XFi76CZX8cbJ4BhTzzA3gU1ZjYZcYW3dwt",
+}
+
+// wanDiscovery wraps a DHT-backed routing discovery layer so the sender and
+// receiver can Advertise/FindPeers under a rendezvous string instead of
+// relying on mDNS, which only works on the local network. It's safe to run
+// alongside the mdns notifee registered in makeHost; the two discovery
+// paths don't interfere with each other.
+type wanDiscovery struct {
+	dht  *dht.IpfsDHT
+	disc *discovery.RoutingDiscovery
+}
+
+// setupWanDiscovery bootstraps a Kademlia DHT against the public bootstrap
+// peers and wraps it in a routing-discovery layer.
+func setupWanDiscovery(ctx context.Context, h *bhost.BasicHost, app *ui.App) (*wanDiscovery, error) {
+	kad, err := dht.New(ctx, h)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := kad.Bootstrap(ctx); err != nil {
+		return nil, err
+	}
+
+	for _, addr := range defaultBootstrapPeers {
+		maddr, err := ma.NewMultiaddr(addr)
+		if err != nil {
+			continue
+		}
+
+		pi, err := pstore.InfoFromP2pAddr(maddr)
+		if err != nil {
+			continue
+		}
+
+		if err := h.Connect(ctx, *pi); err != nil {
+			app.Log.Add(fmt.Sprintf("bootstrap dial to %s failed: %s", pi.ID, err))
+			continue
+		}
+	}
+
+	return &wanDiscovery{
+		dht:  kad,
+		disc: discovery.NewRoutingDiscovery(kad),
+	}, nil
+}
+
+// advertiseLoop advertises rv on the DHT under a long TTL. discovery.Advertise
+// is itself fire-and-forget: it spawns its own background goroutine that
+// keeps re-advertising on a TTL-derived cadence until ctx is cancelled, so
+// calling it more than once here would just stack redundant provide loops on
+// top of each other rather than refreshing anything.
+func (w *wanDiscovery) advertiseLoop(ctx context.Context, rv string) {
+	discovery.Advertise(ctx, w.disc, rv, discovery.TTL(time.Minute*10))
+}
+
+// findPeersLoop looks up peers advertised under rv and dials any we aren't
+// already connected to. Connecting triggers the same conn handler the mdns
+// notifee uses, so the hello exchange just works regardless of which
+// discovery path found the peer.
+func (w *wanDiscovery) findPeersLoop(ctx context.Context, h *bhost.BasicHost, app *ui.App, rv string) {
+	for {
+		peers, err := w.disc.FindPeers(ctx, rv)
+		if err != nil {
+			app.Log.Add(fmt.Sprintf("dht findpeers: %s", err))
+			return
+		}
+
+		for pi := range peers {
+			if pi.ID == h.ID() || len(pi.Addrs) == 0 {
+				continue
+			}
+			if h.Network().Connectedness(pi.ID) == inet.Connected {
+				continue
+			}
+			if err := h.Connect(ctx, pi); err != nil {
+				app.Log.Add(fmt.Sprintf("dht dial to %s failed: %s", pi.ID, err))
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(time.Minute):
+		}
+	}
+}
@@ -87,20 +87,36 @@ func main() {
 	c.Commands = []cli.Command{
 		sendCommand,
 		recvCommand,
+		broadcastCommand,
 	}
 	c.RunAndExitOnError()
 }
 
 type hello struct {
-	Name     string
-	Hostname string
-	File     string
-	Size     uint64
-	peer     peer.ID
+	Name            string
+	Hostname        string
+	File            string
+	Size            uint64
+	FileHash        string
+	Addrs           []string
+	ProtocolVersion string
+	PubKey          []byte
+	Signature       []byte
+	peer            peer.ID
 }
 
 var sendCommand = cli.Command{
 	Name: "send",
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:  "rendezvous",
+			Usage: "rendezvous string to advertise under on the public DHT for WAN discovery",
+		},
+		cli.StringFlag{
+			Name:  "password",
+			Usage: "shared password to derive an AEAD key that wraps the get stream",
+		},
+	},
 	Action: func(c *cli.Context) error {
 		ctx, cancel := context.WithCancel(context.Background())
 		defer cancel()
@@ -110,7 +126,10 @@ var sendCommand = cli.Command{
 			return err
 		}
 
-		finame := c.Args().First()
+		paths := []string(c.Args())
+		if len(paths) == 0 {
+			return fmt.Errorf("usage: p2pdrop send <file|dir> [<file|dir> ...]")
+		}
 
 		name, err := os.Hostname()
 		if err != nil {
@@ -122,21 +141,40 @@ var sendCommand = cli.Command{
 			return err
 		}
 
-		st, err := os.Stat(finame)
+		app := new(ui.App)
+		app.Title = "p2pdrop"
+		app.Log = ui.NewLog(3, 10)
+
+		dm, lookup, err := buildDirManifest(paths)
 		if err != nil {
 			return err
 		}
 
-		app := new(ui.App)
-		app.Title = "p2pdrop"
-		app.Log = ui.NewLog(3, 10)
+		password := c.String("password")
+		registerManifestHandler(h, dm, app)
+		registerChunkedGetHandler(h, newChunkManifestCache(lookup), password, app)
+
+		var selfAddrs []string
+		for _, a := range h.Addrs() {
+			selfAddrs = append(selfAddrs, a.String())
+		}
 
 		myhello := hello{
-			Name:     u.Username,
-			Hostname: name,
-			File:     finame,
-			Size:     uint64(st.Size()),
+			Name:            u.Username,
+			Hostname:        name,
+			File:            describeTransfer(paths, dm),
+			Size:            dm.TotalSize,
+			FileHash:        dm.aggregateHash(),
+			Addrs:           selfAddrs,
+			ProtocolVersion: "2.0.0",
 		}
+
+		priv := h.Peerstore().PrivKey(h.ID())
+		if err := signHello(priv, &myhello); err != nil {
+			return err
+		}
+		app.Log.Add(fmt.Sprintf("your safety number: %s", safetyNumber(myhello.PubKey)))
+
 		h.Network().SetConnHandler(func(c inet.Conn) {
 			s, err := h.NewStream(ctx, c.RemotePeer(), "/p2pdrop/1.0.0/hello")
 			if err != nil {
@@ -161,19 +199,14 @@ var sendCommand = cli.Command{
 
 			app.Log.Add(fmt.Sprintf("Found someone: %s@%s - %s (%s)", otherhello.Name, otherhello.Hostname, otherhello.File, human.Bytes(otherhello.Size)))
 		})
-		h.SetStreamHandler("/p2pdrop/1.0.0/get", func(s inet.Stream) {
-			defer s.Close()
-			fi, err := os.Open(finame)
-			if err != nil {
-				fmt.Println("error opening file: ", err)
-				return
-			}
-			_, err = io.Copy(s, fi)
+
+		if rv := c.String("rendezvous"); rv != "" {
+			wd, err := setupWanDiscovery(ctx, h, app)
 			if err != nil {
-				fmt.Println("error copying file: ", err)
-				return
+				return err
 			}
-		})
+			go wd.advertiseLoop(ctx, rv)
+		}
 
 		for range time.Tick(time.Second) {
 			app.Print()
@@ -184,6 +217,16 @@ var sendCommand = cli.Command{
 
 var recvCommand = cli.Command{
 	Name: "recv",
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:  "rendezvous",
+			Usage: "rendezvous string to search for on the public DHT for WAN discovery",
+		},
+		cli.StringFlag{
+			Name:  "password",
+			Usage: "shared password to derive an AEAD key that wraps the get stream",
+		},
+	},
 	Action: func(c *cli.Context) error {
 		ctx, cancel := context.WithCancel(context.Background())
 		defer cancel()
@@ -211,6 +254,9 @@ var recvCommand = cli.Command{
 			Name:     u.Username,
 			Hostname: name,
 		}
+		if err := signHello(h.Peerstore().PrivKey(h.ID()), &myhello); err != nil {
+			return err
+		}
 
 		h.Network().SetConnHandler(func(c inet.Conn) {
 			s, err := h.NewStream(ctx, c.RemotePeer(), "/p2pdrop/1.0.0/hello")
@@ -241,14 +287,32 @@ var recvCommand = cli.Command{
 
 			otherhello.peer = s.Conn().RemotePeer()
 
+			if err := verifyHello(&otherhello); err != nil {
+				app.Log.Add(fmt.Sprintf("rejecting hello from %s: %s", otherhello.peer, err))
+				return
+			}
+
+			if claimed, err := peerIDFromHello(&otherhello); err != nil || claimed != otherhello.peer {
+				app.Log.Add(fmt.Sprintf("rejecting hello from %s: signed by a different peer than we're connected to", otherhello.peer))
+				return
+			}
+
 			hellolk.Lock()
 			n := len(hellos)
 			hellos = append(hellos, otherhello)
 			hellolk.Unlock()
 
-			app.Log.Add(fmt.Sprintf("%d: %s@%s - %s (%s)", n, otherhello.Name, otherhello.Hostname, otherhello.File, human.Bytes(otherhello.Size)))
+			app.Log.Add(fmt.Sprintf("%d: %s@%s - %s (%s) [safety number: %s]", n, otherhello.Name, otherhello.Hostname, otherhello.File, human.Bytes(otherhello.Size), safetyNumber(otherhello.PubKey)))
 		})
 
+		if rv := c.String("rendezvous"); rv != "" {
+			wd, err := setupWanDiscovery(ctx, h, app)
+			if err != nil {
+				return err
+			}
+			go wd.findPeersLoop(ctx, h, app, rv)
+		}
+
 		app.NewDataLine(13, "Select file by number:", "")
 		app.NewDataLine(2, "-------", "")
 		go func() {
@@ -270,6 +334,44 @@ var recvCommand = cli.Command{
 			hellolk.Unlock()
 
 			fmt.Printf("fetching %s from %s\n", hl.File, hl.Name)
+
+			if hl.ProtocolVersion == "2.0.0" {
+				dm, err := fetchManifest(ctx, h, hl.peer)
+				if err != nil {
+					fmt.Println("fetch manifest err: ", err)
+					break
+				}
+
+				if dm.aggregateHash() != hl.FileHash {
+					fmt.Println("fetch err: manifest hash does not match the hash signed in the sender's hello")
+					break
+				}
+
+				password := c.String("password")
+				failed := false
+				for _, entry := range dm.Entries {
+					outPath, err := safeJoin(".", entry.RelPath)
+					if err != nil {
+						fmt.Println("fetch err: ", err)
+						failed = true
+						break
+					}
+					fmt.Printf("fetching %s (%s)\n", entry.RelPath, human.Bytes(entry.Size))
+					if err := fetchChunked(ctx, h, hl.peer, entry.RelPath, outPath, password, app); err != nil {
+						fmt.Println("fetch err: ", err)
+						failed = true
+						break
+					}
+					if err := os.Chmod(outPath, entry.Mode); err != nil {
+						app.Log.Add(fmt.Sprintf("chmod %s: %s", outPath, err))
+					}
+				}
+				if !failed {
+					fmt.Println("Success!")
+				}
+				break
+			}
+
 			s, err := h.NewStream(ctx, hl.peer, "/p2pdrop/1.0.0/get")
 			if err != nil {
 				fmt.Println("Errr:", err)
@@ -294,3 +396,47 @@ var recvCommand = cli.Command{
 		return nil
 	},
 }
+
+var broadcastCommand = cli.Command{
+	Name:  "broadcast",
+	Usage: "serve a file/directory to, or browse, everyone in a pubsub room, without needing mDNS or a direct connection",
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:  "room",
+			Usage: "room name both sides agree on; derives the gossipsub topic (required)",
+		},
+		cli.StringFlag{
+			Name:  "password",
+			Usage: "shared password to derive an AEAD key that wraps the get stream",
+		},
+	},
+	Action: func(c *cli.Context) error {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		room := c.String("room")
+		if room == "" {
+			return fmt.Errorf("broadcast requires --room")
+		}
+
+		h, err := makeHost()
+		if err != nil {
+			return err
+		}
+
+		app := new(ui.App)
+		app.Title = "p2pdrop broadcast"
+		app.Log = ui.NewLog(3, 10)
+		go func() {
+			for range time.Tick(time.Second) {
+				app.Print()
+			}
+		}()
+
+		paths := []string(c.Args())
+		if len(paths) > 0 {
+			return runBroadcastSender(ctx, h, room, paths, c.String("password"), app)
+		}
+		return runBroadcastReceiver(ctx, h, room, c.String("password"), app)
+	},
+}
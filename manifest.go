@@ -0,0 +1,243 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	human "github.com/dustin/go-humanize"
+	inet "github.com/libp2p/go-libp2p-net"
+	peer "github.com/libp2p/go-libp2p-peer"
+	bhost "github.com/libp2p/go-libp2p/p2p/host/basic"
+	ui "github.com/whyrusleeping/gooey"
+)
+
+// protoManifest lets a receiver ask what a sender actually has on offer
+// before fetching anything: a flat list of relPath/size/mode/hash entries
+// covering every file under every path the sender was given, whether that
+// was a single file, several files, or whole directories.
+const protoManifest = "/p2pdrop/1.1.0/manifest"
+
+// fileEntry describes a single file within a dirManifest.
+type fileEntry struct {
+	RelPath string      `json:"relPath"`
+	Size    uint64      `json:"size"`
+	Mode    os.FileMode `json:"mode"`
+	Hash    string      `json:"hash"`
+}
+
+// dirManifest is the aggregate of everything a sendCommand invocation is
+// serving: one entry per file, each named by the relative path a receiver
+// should ask for on protoGetV2.
+type dirManifest struct {
+	Entries   []fileEntry `json:"entries"`
+	TotalSize uint64      `json:"totalSize"`
+}
+
+// buildDirManifest walks every path in paths (a plain file is a one-entry
+// walk, a directory is walked recursively) and hashes each file it finds.
+// It returns the manifest alongside a relPath -> absolute path lookup so
+// the /get handler can serve whichever entry is requested.
+func buildDirManifest(paths []string) (*dirManifest, map[string]string, error) {
+	dm := &dirManifest{}
+	lookup := map[string]string{}
+
+	for _, root := range paths {
+		st, err := os.Stat(root)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		base := filepath.Base(root)
+
+		if !st.IsDir() {
+			hash, err := hashFile(root)
+			if err != nil {
+				return nil, nil, err
+			}
+
+			dm.Entries = append(dm.Entries, fileEntry{
+				RelPath: base,
+				Size:    uint64(st.Size()),
+				Mode:    st.Mode(),
+				Hash:    hash,
+			})
+			dm.TotalSize += uint64(st.Size())
+			lookup[base] = root
+			continue
+		}
+
+		err = filepath.Walk(root, func(p string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			if info.IsDir() {
+				return nil
+			}
+
+			rel, err := filepath.Rel(filepath.Dir(root), p)
+			if err != nil {
+				return err
+			}
+			rel = filepath.ToSlash(rel)
+
+			hash, err := hashFile(p)
+			if err != nil {
+				return err
+			}
+
+			dm.Entries = append(dm.Entries, fileEntry{
+				RelPath: rel,
+				Size:    uint64(info.Size()),
+				Mode:    info.Mode(),
+				Hash:    hash,
+			})
+			dm.TotalSize += uint64(info.Size())
+			lookup[rel] = p
+			return nil
+		})
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	return dm, lookup, nil
+}
+
+// safeJoin joins base with relPath the way a protoManifest entry's RelPath
+// should be joined into an output path: relPath comes from whichever peer
+// is serving the transfer, so it's untrusted input. Cleaning it and
+// rejecting anything that still escapes base (via ".." segments or an
+// absolute path) stops a malicious sender from writing outside the
+// receiver's chosen output directory.
+func safeJoin(base, relPath string) (string, error) {
+	if filepath.IsAbs(relPath) {
+		return "", fmt.Errorf("entry %q: absolute paths are not allowed", relPath)
+	}
+
+	joined := filepath.Join(base, relPath)
+	rel, err := filepath.Rel(base, joined)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("entry %q escapes the output directory", relPath)
+	}
+
+	return joined, nil
+}
+
+// hashFile computes the sha256 of the whole file, used for the directory
+// manifest's coarse per-entry integrity check (as opposed to the per-chunk
+// hashes protoGetV2 uses while actually transferring one entry).
+func hashFile(path string) (string, error) {
+	fi, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer fi.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, fi); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// aggregateHash combines every entry's hash into one, so the hello's
+// signature can cover a whole multi-file transfer without each side having
+// to name every entry up front.
+func (dm *dirManifest) aggregateHash() string {
+	h := sha256.New()
+	for _, e := range dm.Entries {
+		h.Write([]byte(e.RelPath))
+		h.Write([]byte(e.Hash))
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// describeTransfer builds the short human-readable label that goes in a
+// hello's File field: the single relPath when there's exactly one entry,
+// otherwise an aggregate like "photos/ (3 files, 12 MB)".
+func describeTransfer(paths []string, dm *dirManifest) string {
+	if len(dm.Entries) == 1 {
+		return dm.Entries[0].RelPath
+	}
+
+	label := "files"
+	if len(paths) == 1 {
+		if st, err := os.Stat(paths[0]); err == nil && st.IsDir() {
+			label = filepath.Base(paths[0]) + "/"
+		}
+	}
+
+	return fmt.Sprintf("%s (%d files, %s)", label, len(dm.Entries), human.Bytes(dm.TotalSize))
+}
+
+// registerManifestHandler serves dm as JSON to anyone who opens a
+// protoManifest stream.
+func registerManifestHandler(h *bhost.BasicHost, dm *dirManifest, app *ui.App) {
+	h.SetStreamHandler(protoManifest, func(s inet.Stream) {
+		defer s.Close()
+		if err := json.NewEncoder(s).Encode(dm); err != nil {
+			app.Log.Add(fmt.Sprintf("sending manifest: %s", err))
+		}
+	})
+}
+
+// fetchManifest opens a protoManifest stream to p and decodes the
+// dirManifest it sends.
+func fetchManifest(ctx context.Context, h *bhost.BasicHost, p peer.ID) (*dirManifest, error) {
+	s, err := h.NewStream(ctx, p, protoManifest)
+	if err != nil {
+		return nil, err
+	}
+	defer s.Close()
+
+	var dm dirManifest
+	if err := json.NewDecoder(s).Decode(&dm); err != nil {
+		return nil, err
+	}
+	return &dm, nil
+}
+
+// chunkManifestCache lazily builds and caches the per-chunk manifest for
+// each relPath the sender serves, so repeated or resumed requests for the
+// same entry don't re-hash the file from scratch.
+type chunkManifestCache struct {
+	lookup map[string]string
+
+	mu    sync.Mutex
+	cache map[string]*manifest
+}
+
+func newChunkManifestCache(lookup map[string]string) *chunkManifestCache {
+	return &chunkManifestCache{lookup: lookup, cache: map[string]*manifest{}}
+}
+
+// resolve returns the per-chunk manifest and absolute path for relPath,
+// building and caching the manifest on first use.
+func (c *chunkManifestCache) resolve(relPath string) (string, *manifest, error) {
+	absPath, ok := c.lookup[relPath]
+	if !ok {
+		return "", nil, fmt.Errorf("no such entry: %s", relPath)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if m, ok := c.cache[relPath]; ok {
+		return absPath, m, nil
+	}
+
+	m, err := buildManifest(absPath)
+	if err != nil {
+		return "", nil, err
+	}
+	c.cache[relPath] = m
+	return absPath, m, nil
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"sort"
+
+	peer "github.com/libp2p/go-libp2p-peer"
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/hkdf"
+)
+
+// maxAEADPlaintext bounds how much plaintext goes into a single AEAD frame,
+// so we never have to buffer an unbounded amount of data to encrypt or
+// decrypt one chunk.
+const maxAEADPlaintext = 64 * 1024
+
+// sessionSaltSize is the size of the per-stream salt the initiator
+// generates and sends in the clear before any AEAD framing starts. Mixing
+// it into the HKDF derivation means every protoGetV2 stream gets its own
+// key, even when the same --password is reused across a multi-file
+// transfer or a resumed fetch.
+const sessionSaltSize = 16
+
+// derivePasswordSecret turns a shared --password plus the two peers' IDs
+// into a base secret via Argon2id. The salt is the hash of the two peer
+// IDs sorted lexically, so both sides derive the same secret regardless of
+// which one is the sender. This secret is never used as an AEAD key
+// directly — deriveDirectionalKeys expands it per stream and per direction.
+func derivePasswordSecret(password string, a, b peer.ID) []byte {
+	ids := []string{a.Pretty(), b.Pretty()}
+	sort.Strings(ids)
+	salt := sha256.Sum256([]byte(ids[0] + ids[1]))
+	return argon2.IDKey([]byte(password), salt[:], 1, 64*1024, 4, chacha20poly1305.KeySize)
+}
+
+// deriveDirectionalKeys expands secret plus the per-stream sessionSalt into
+// two distinct keys, one per direction of traffic between self and remote.
+// Keying each direction separately (rather than one shared key with
+// independent nonce counters) means the two sides can never seal different
+// plaintext under the same (key, nonce) pair.
+func deriveDirectionalKeys(secret, sessionSalt []byte, self, remote peer.ID) (sendKey, recvKey []byte, err error) {
+	selfIsLow := self.Pretty() < remote.Pretty()
+
+	ids := []string{self.Pretty(), remote.Pretty()}
+	sort.Strings(ids)
+
+	lowToHigh, err := hkdfExpand(secret, sessionSalt, ids[0]+"->"+ids[1])
+	if err != nil {
+		return nil, nil, err
+	}
+	highToLow, err := hkdfExpand(secret, sessionSalt, ids[1]+"->"+ids[0])
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if selfIsLow {
+		return lowToHigh, highToLow, nil
+	}
+	return highToLow, lowToHigh, nil
+}
+
+func hkdfExpand(secret, salt []byte, info string) ([]byte, error) {
+	r := hkdf.New(sha256.New, secret, salt, []byte(info))
+	key := make([]byte, chacha20poly1305.KeySize)
+	if _, err := io.ReadFull(r, key); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// aeadStream wraps a raw stream in a framed chacha20poly1305 layer: each
+// frame is a 4-byte big-endian ciphertext length followed by the sealed
+// bytes. A peer without the right password will fail to open the very
+// first frame instead of reading a corrupted manifest or file. Reads and
+// writes use separate AEAD instances, keyed for their own direction, so
+// the two sides never reuse a (key, nonce) pair on each other's traffic.
+type aeadStream struct {
+	rw         io.ReadWriter
+	sendAEAD   cipher.AEAD
+	recvAEAD   cipher.AEAD
+	writeNonce uint64
+	readNonce  uint64
+	readBuf    []byte
+}
+
+// newAEADStream sets up the encrypted layer for one protoGetV2 stream.
+// initiator must be true for the side that opened the stream (the
+// fetcher) and false for the side that accepted it (the handler); they
+// must agree, since the initiator generates and sends the per-stream
+// session salt that the responder reads back.
+func newAEADStream(rw io.ReadWriter, password string, self, remote peer.ID, initiator bool) (*aeadStream, error) {
+	secret := derivePasswordSecret(password, self, remote)
+
+	var sessionSalt [sessionSaltSize]byte
+	if initiator {
+		if _, err := rand.Read(sessionSalt[:]); err != nil {
+			return nil, err
+		}
+		if _, err := rw.Write(sessionSalt[:]); err != nil {
+			return nil, err
+		}
+	} else {
+		if _, err := io.ReadFull(rw, sessionSalt[:]); err != nil {
+			return nil, err
+		}
+	}
+
+	sendKey, recvKey, err := deriveDirectionalKeys(secret, sessionSalt[:], self, remote)
+	if err != nil {
+		return nil, err
+	}
+
+	sendAEAD, err := chacha20poly1305.New(sendKey)
+	if err != nil {
+		return nil, err
+	}
+	recvAEAD, err := chacha20poly1305.New(recvKey)
+	if err != nil {
+		return nil, err
+	}
+
+	return &aeadStream{rw: rw, sendAEAD: sendAEAD, recvAEAD: recvAEAD}, nil
+}
+
+func nonceFor(aead cipher.AEAD, counter uint64) []byte {
+	nonce := make([]byte, aead.NonceSize())
+	binary.BigEndian.PutUint64(nonce[aead.NonceSize()-8:], counter)
+	return nonce
+}
+
+func (a *aeadStream) Write(p []byte) (int, error) {
+	total := 0
+	for len(p) > 0 {
+		n := len(p)
+		if n > maxAEADPlaintext {
+			n = maxAEADPlaintext
+		}
+
+		sealed := a.sendAEAD.Seal(nil, nonceFor(a.sendAEAD, a.writeNonce), p[:n], nil)
+		a.writeNonce++
+
+		var lenBuf [4]byte
+		binary.BigEndian.PutUint32(lenBuf[:], uint32(len(sealed)))
+		if _, err := a.rw.Write(lenBuf[:]); err != nil {
+			return total, err
+		}
+		if _, err := a.rw.Write(sealed); err != nil {
+			return total, err
+		}
+
+		total += n
+		p = p[n:]
+	}
+	return total, nil
+}
+
+func (a *aeadStream) Read(p []byte) (int, error) {
+	for len(a.readBuf) == 0 {
+		var lenBuf [4]byte
+		if _, err := io.ReadFull(a.rw, lenBuf[:]); err != nil {
+			return 0, err
+		}
+
+		sealed := make([]byte, binary.BigEndian.Uint32(lenBuf[:]))
+		if _, err := io.ReadFull(a.rw, sealed); err != nil {
+			return 0, err
+		}
+
+		plain, err := a.recvAEAD.Open(nil, nonceFor(a.recvAEAD, a.readNonce), sealed, nil)
+		a.readNonce++
+		if err != nil {
+			return 0, fmt.Errorf("auth failure: wrong password or corrupted stream: %s", err)
+		}
+
+		a.readBuf = plain
+	}
+
+	n := copy(p, a.readBuf)
+	a.readBuf = a.readBuf[n:]
+	return n, nil
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"testing"
+
+	peer "github.com/libp2p/go-libp2p-peer"
+)
+
+// pipe is an io.ReadWriter that loops a writer's bytes back as a reader's
+// input, so each side of an aeadStream pair can talk to the other without a
+// real network connection.
+type pipe struct {
+	r *io.PipeReader
+	w *io.PipeWriter
+}
+
+func (p *pipe) Read(b []byte) (int, error)  { return p.r.Read(b) }
+func (p *pipe) Write(b []byte) (int, error) { return p.w.Write(b) }
+
+// newPipePair returns two pipes wired so writes to one are reads from the
+// other, like the two ends of a libp2p stream.
+func newPipePair() (*pipe, *pipe) {
+	r1, w1 := io.Pipe()
+	r2, w2 := io.Pipe()
+	return &pipe{r: r1, w: w2}, &pipe{r: r2, w: w1}
+}
+
+func TestAEADStreamRoundtrip(t *testing.T) {
+	self, err := peer.IDB58Decode("QmYyQSo1c1Ym7orWxLYvCrM2EmxFTANf8wXmmE7DWjhx5N")
+	if err != nil {
+		t.Fatalf("decoding test peer id: %s", err)
+	}
+	remote, err := peer.IDB58Decode("QmUNLLsPACCz1vLxQVkXqqLX5R1X345qqfHbsf67hvA3Nn")
+	if err != nil {
+		t.Fatalf("decoding test peer id: %s", err)
+	}
+
+	initiatorConn, responderConn := newPipePair()
+
+	type result struct {
+		as  *aeadStream
+		err error
+	}
+	initiatorCh := make(chan result, 1)
+	responderCh := make(chan result, 1)
+
+	go func() {
+		as, err := newAEADStream(initiatorConn, "hunter2", self, remote, true)
+		initiatorCh <- result{as, err}
+	}()
+	go func() {
+		as, err := newAEADStream(responderConn, "hunter2", remote, self, false)
+		responderCh <- result{as, err}
+	}()
+
+	ir := <-initiatorCh
+	rr := <-responderCh
+	if ir.err != nil {
+		t.Fatalf("initiator newAEADStream: %s", ir.err)
+	}
+	if rr.err != nil {
+		t.Fatalf("responder newAEADStream: %s", rr.err)
+	}
+
+	msg := []byte("the quick brown fox jumps over the lazy dog")
+	done := make(chan error, 1)
+	go func() {
+		_, err := ir.as.Write(msg)
+		done <- err
+	}()
+
+	got := make([]byte, len(msg))
+	if _, err := io.ReadFull(rr.as, got); err != nil {
+		t.Fatalf("reading message: %s", err)
+	}
+	if err := <-done; err != nil {
+		t.Fatalf("writing message: %s", err)
+	}
+	if !bytes.Equal(got, msg) {
+		t.Errorf("roundtripped message = %q, want %q", got, msg)
+	}
+}
+
+func TestDeriveDirectionalKeysAreDistinctAndSymmetric(t *testing.T) {
+	self, err := peer.IDB58Decode("QmYyQSo1c1Ym7orWxLYvCrM2EmxFTANf8wXmmE7DWjhx5N")
+	if err != nil {
+		t.Fatalf("decoding test peer id: %s", err)
+	}
+	remote, err := peer.IDB58Decode("QmUNLLsPACCz1vLxQVkXqqLX5R1X345qqfHbsf67hvA3Nn")
+	if err != nil {
+		t.Fatalf("decoding test peer id: %s", err)
+	}
+
+	secret := derivePasswordSecret("hunter2", self, remote)
+	salt := []byte("a fixed 16B salt")
+
+	selfSend, selfRecv, err := deriveDirectionalKeys(secret, salt, self, remote)
+	if err != nil {
+		t.Fatalf("deriveDirectionalKeys (self): %s", err)
+	}
+	remoteSend, remoteRecv, err := deriveDirectionalKeys(secret, salt, remote, self)
+	if err != nil {
+		t.Fatalf("deriveDirectionalKeys (remote): %s", err)
+	}
+
+	if bytes.Equal(selfSend, selfRecv) {
+		t.Error("send and recv keys for one side must not be equal")
+	}
+	if !bytes.Equal(selfSend, remoteRecv) {
+		t.Error("self's send key must equal remote's recv key")
+	}
+	if !bytes.Equal(selfRecv, remoteSend) {
+		t.Error("self's recv key must equal remote's send key")
+	}
+}
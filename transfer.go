@@ -0,0 +1,333 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	inet "github.com/libp2p/go-libp2p-net"
+	peer "github.com/libp2p/go-libp2p-peer"
+	bhost "github.com/libp2p/go-libp2p/p2p/host/basic"
+	ui "github.com/whyrusleeping/gooey"
+)
+
+// protoGetV2 is the resumable, hash-verified successor to the original
+// /p2pdrop/1.0.0/get, which just io.Copy'd the raw file with no way to
+// resume an interrupted transfer or detect corruption.
+const protoGetV2 = "/p2pdrop/2.0.0/get"
+
+// chunkSize is the unit both sides chunk the file into for hashing,
+// resuming and framing. 1 MiB keeps the per-chunk hash cheap while still
+// giving a reasonable resume granularity.
+const chunkSize = 1 << 20
+
+// manifest describes a file as a sequence of fixed-size chunks, each with
+// its own hash, plus a hash over the whole file. It's sent first on
+// protoGetV2 so the receiver knows what it's asking for before any bytes
+// move.
+type manifest struct {
+	Size        uint64   `json:"size"`
+	ChunkSize   uint64   `json:"chunkSize"`
+	ChunkHashes []string `json:"chunkHashes"`
+	Hash        string   `json:"hash"`
+}
+
+// numChunks returns how many chunks the file is split into.
+func (m *manifest) numChunks() int {
+	return len(m.ChunkHashes)
+}
+
+// buildManifest hashes path in chunkSize blocks, producing both the
+// per-chunk hashes and the overall file hash in a single pass.
+func buildManifest(path string) (*manifest, error) {
+	fi, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer fi.Close()
+
+	st, err := fi.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	overall := sha256.New()
+	buf := make([]byte, chunkSize)
+
+	m := &manifest{
+		Size:      uint64(st.Size()),
+		ChunkSize: chunkSize,
+	}
+
+	for {
+		n, err := io.ReadFull(fi, buf)
+		if n > 0 {
+			chunk := sha256.Sum256(buf[:n])
+			m.ChunkHashes = append(m.ChunkHashes, hex.EncodeToString(chunk[:]))
+			overall.Write(buf[:n])
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	m.Hash = hex.EncodeToString(overall.Sum(nil))
+	return m, nil
+}
+
+// fetchRequest is the first message the receiver sends on protoGetV2,
+// naming which manifest entry it wants by relPath.
+type fetchRequest struct {
+	RelPath string `json:"relPath"`
+}
+
+// getRequest is what the receiver sends after reading that entry's
+// manifest: the set of chunk indices it still needs. Fresh means "I have
+// no usable resume state for this file, send everything": the sender then
+// enumerates every index itself and ignores Missing (fetchChunked still
+// lists every index in Missing in that case). An empty Missing without
+// Fresh means the receiver already has every chunk, so nothing is sent.
+type getRequest struct {
+	Fresh   bool     `json:"fresh"`
+	Missing []uint32 `json:"missing"`
+}
+
+// chunkHeader precedes each chunk's bytes on the wire.
+type chunkHeader struct {
+	Index uint32
+	Len   uint32
+}
+
+// transferState is the sidecar persisted next to a partial download as
+// <file>.p2pdrop-state, so a restarted receiver knows which chunks it
+// already has without re-verifying the whole file.
+type transferState struct {
+	Size uint64 `json:"size"`
+	Hash string `json:"hash"`
+	Have []bool `json:"have"`
+}
+
+func statePath(outPath string) string { return outPath + ".p2pdrop-state" }
+func partPath(outPath string) string  { return outPath + ".part" }
+
+// loadState reads the sidecar for outPath, returning a fresh all-false
+// state (and fresh=true) if there isn't one yet or it doesn't match m
+// (e.g. the sender is now serving a different file under the same name).
+func loadState(outPath string, m *manifest) (*transferState, bool) {
+	raw, err := ioutil.ReadFile(statePath(outPath))
+	if err == nil {
+		var st transferState
+		if err := json.Unmarshal(raw, &st); err == nil && st.Size == m.Size && st.Hash == m.Hash && len(st.Have) == m.numChunks() {
+			return &st, false
+		}
+	}
+	return &transferState{Size: m.Size, Hash: m.Hash, Have: make([]bool, m.numChunks())}, true
+}
+
+func saveState(outPath string, st *transferState) error {
+	raw, err := json.Marshal(st)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(statePath(outPath), raw, 0644)
+}
+
+// registerChunkedGetHandler serves entries out of cache over protoGetV2:
+// the receiver first names a relPath, then gets that entry's chunk
+// manifest, then says which chunks it still needs, then gets just those
+// chunks framed with a chunkHeader. If password is non-empty, the whole
+// exchange is wrapped in a per-peer AEAD layer so a receiver without the
+// right password gets an auth failure instead of a parseable-but-wrong
+// manifest.
+func registerChunkedGetHandler(h *bhost.BasicHost, cache *chunkManifestCache, password string, app *ui.App) {
+	h.SetStreamHandler(protoGetV2, func(s inet.Stream) {
+		defer s.Close()
+
+		var rw io.ReadWriter = s
+		if password != "" {
+			as, err := newAEADStream(s, password, h.ID(), s.Conn().RemotePeer(), false)
+			if err != nil {
+				app.Log.Add(fmt.Sprintf("setting up encrypted stream: %s", err))
+				return
+			}
+			rw = as
+		}
+
+		var freq fetchRequest
+		if err := json.NewDecoder(rw).Decode(&freq); err != nil {
+			app.Log.Add(fmt.Sprintf("reading fetch request: %s", err))
+			return
+		}
+
+		path, m, err := cache.resolve(freq.RelPath)
+		if err != nil {
+			app.Log.Add(fmt.Sprintf("resolving %s: %s", freq.RelPath, err))
+			return
+		}
+
+		if err := json.NewEncoder(rw).Encode(m); err != nil {
+			app.Log.Add(fmt.Sprintf("sending manifest: %s", err))
+			return
+		}
+
+		var req getRequest
+		if err := json.NewDecoder(rw).Decode(&req); err != nil {
+			app.Log.Add(fmt.Sprintf("reading get request: %s", err))
+			return
+		}
+
+		indices := req.Missing
+		if req.Fresh {
+			indices = make([]uint32, m.numChunks())
+			for i := range indices {
+				indices[i] = uint32(i)
+			}
+		}
+
+		fi, err := os.Open(path)
+		if err != nil {
+			app.Log.Add(fmt.Sprintf("opening %s: %s", path, err))
+			return
+		}
+		defer fi.Close()
+
+		buf := make([]byte, chunkSize)
+		for _, idx := range indices {
+			off := int64(idx) * chunkSize
+			n, err := fi.ReadAt(buf, off)
+			if err != nil && err != io.EOF {
+				app.Log.Add(fmt.Sprintf("reading chunk %d: %s", idx, err))
+				return
+			}
+
+			hdr := chunkHeader{Index: idx, Len: uint32(n)}
+			if err := binary.Write(rw, binary.BigEndian, hdr); err != nil {
+				app.Log.Add(fmt.Sprintf("writing chunk %d header: %s", idx, err))
+				return
+			}
+			if _, err := rw.Write(buf[:n]); err != nil {
+				app.Log.Add(fmt.Sprintf("writing chunk %d: %s", idx, err))
+				return
+			}
+		}
+	})
+}
+
+// fetchChunked runs the receiver side of protoGetV2 against p for the
+// entry named relPath, resuming from any existing <outPath>.part/
+// .p2pdrop-state pair, verifying every chunk's hash as it arrives, and
+// only renaming into outPath once the whole file's hash checks out.
+func fetchChunked(ctx context.Context, h *bhost.BasicHost, p peer.ID, relPath, outPath string, password string, app *ui.App) error {
+	s, err := h.NewStream(ctx, p, protoGetV2)
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+
+	var rw io.ReadWriter = s
+	if password != "" {
+		as, err := newAEADStream(s, password, h.ID(), p, true)
+		if err != nil {
+			return err
+		}
+		rw = as
+	}
+
+	if err := json.NewEncoder(rw).Encode(fetchRequest{RelPath: relPath}); err != nil {
+		return fmt.Errorf("sending fetch request: %s", err)
+	}
+
+	var m manifest
+	if err := json.NewDecoder(rw).Decode(&m); err != nil {
+		return fmt.Errorf("reading manifest: %s", err)
+	}
+
+	st, fresh := loadState(outPath, &m)
+
+	var missing []uint32
+	for i, have := range st.Have {
+		if !have {
+			missing = append(missing, uint32(i))
+		}
+	}
+
+	if err := json.NewEncoder(rw).Encode(getRequest{Fresh: fresh, Missing: missing}); err != nil {
+		return fmt.Errorf("sending get request: %s", err)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(outPath), 0755); err != nil {
+		return err
+	}
+
+	out, err := os.OpenFile(partPath(outPath), os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	if err := out.Truncate(int64(m.Size)); err != nil {
+		return err
+	}
+
+	for range missing {
+		var hdr chunkHeader
+		if err := binary.Read(rw, binary.BigEndian, &hdr); err != nil {
+			return fmt.Errorf("reading chunk header: %s", err)
+		}
+
+		if int(hdr.Index) >= m.numChunks() {
+			return fmt.Errorf("chunk index %d out of range (manifest has %d chunks)", hdr.Index, m.numChunks())
+		}
+		if hdr.Len > chunkSize {
+			return fmt.Errorf("chunk %d claims length %d, more than chunkSize %d", hdr.Index, hdr.Len, chunkSize)
+		}
+
+		buf := make([]byte, hdr.Len)
+		if _, err := io.ReadFull(rw, buf); err != nil {
+			return fmt.Errorf("reading chunk %d: %s", hdr.Index, err)
+		}
+
+		sum := sha256.Sum256(buf)
+		if hex.EncodeToString(sum[:]) != m.ChunkHashes[hdr.Index] {
+			return fmt.Errorf("chunk %d failed hash verification", hdr.Index)
+		}
+
+		if _, err := out.WriteAt(buf, int64(hdr.Index)*chunkSize); err != nil {
+			return err
+		}
+
+		st.Have[hdr.Index] = true
+		if err := saveState(outPath, st); err != nil {
+			app.Log.Add(fmt.Sprintf("persisting resume state: %s", err))
+		}
+	}
+
+	if err := out.Close(); err != nil {
+		return err
+	}
+
+	finalManifest, err := buildManifest(partPath(outPath))
+	if err != nil {
+		return err
+	}
+	if finalManifest.Hash != m.Hash {
+		return fmt.Errorf("assembled file hash %s does not match manifest hash %s", finalManifest.Hash, m.Hash)
+	}
+
+	if err := os.Rename(partPath(outPath), outPath); err != nil {
+		return err
+	}
+	os.Remove(statePath(outPath))
+
+	return nil
+}
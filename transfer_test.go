@@ -0,0 +1,123 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func writeTempFile(t *testing.T, dir string, size int) string {
+	t.Helper()
+
+	path := filepath.Join(dir, "data")
+	buf := make([]byte, size)
+	for i := range buf {
+		buf[i] = byte(i)
+	}
+	if err := ioutil.WriteFile(path, buf, 0644); err != nil {
+		t.Fatalf("writing temp file: %s", err)
+	}
+	return path
+}
+
+func TestBuildManifest(t *testing.T) {
+	dir, err := ioutil.TempDir("", "p2pdrop-test")
+	if err != nil {
+		t.Fatalf("tempdir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	size := int(chunkSize)*2 + 17
+	path := writeTempFile(t, dir, size)
+
+	m, err := buildManifest(path)
+	if err != nil {
+		t.Fatalf("buildManifest: %s", err)
+	}
+
+	if m.Size != uint64(size) {
+		t.Errorf("Size = %d, want %d", m.Size, size)
+	}
+	if m.numChunks() != 3 {
+		t.Errorf("numChunks() = %d, want 3", m.numChunks())
+	}
+
+	m2, err := buildManifest(path)
+	if err != nil {
+		t.Fatalf("buildManifest (second pass): %s", err)
+	}
+	if m2.Hash != m.Hash {
+		t.Errorf("hashing the same file twice produced different hashes: %s != %s", m2.Hash, m.Hash)
+	}
+	for i := range m.ChunkHashes {
+		if m2.ChunkHashes[i] != m.ChunkHashes[i] {
+			t.Errorf("chunk %d hash mismatch across passes", i)
+		}
+	}
+}
+
+func TestLoadStateFreshAndRoundtrip(t *testing.T) {
+	dir, err := ioutil.TempDir("", "p2pdrop-test")
+	if err != nil {
+		t.Fatalf("tempdir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	outPath := filepath.Join(dir, "out")
+	m := &manifest{Size: 10, ChunkSize: chunkSize, ChunkHashes: []string{"a", "b"}, Hash: "h"}
+
+	st, fresh := loadState(outPath, m)
+	if !fresh {
+		t.Error("loadState with no sidecar on disk should report fresh = true")
+	}
+	if st.Size != m.Size || st.Hash != m.Hash || len(st.Have) != m.numChunks() {
+		t.Fatalf("fresh state didn't match manifest: %+v", st)
+	}
+	for i, have := range st.Have {
+		if have {
+			t.Errorf("chunk %d marked have on a fresh state", i)
+		}
+	}
+
+	st.Have[0] = true
+	if err := saveState(outPath, st); err != nil {
+		t.Fatalf("saveState: %s", err)
+	}
+
+	reloaded, fresh := loadState(outPath, m)
+	if fresh {
+		t.Error("loadState with a matching sidecar on disk should report fresh = false")
+	}
+	if !reloaded.Have[0] || reloaded.Have[1] {
+		t.Errorf("reloaded state = %v, want [true false]", reloaded.Have)
+	}
+}
+
+func TestLoadStateDiscardsOnManifestMismatch(t *testing.T) {
+	dir, err := ioutil.TempDir("", "p2pdrop-test")
+	if err != nil {
+		t.Fatalf("tempdir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	outPath := filepath.Join(dir, "out")
+	m := &manifest{Size: 10, ChunkSize: chunkSize, ChunkHashes: []string{"a", "b"}, Hash: "h"}
+
+	st, _ := loadState(outPath, m)
+	st.Have[0] = true
+	if err := saveState(outPath, st); err != nil {
+		t.Fatalf("saveState: %s", err)
+	}
+
+	different := &manifest{Size: 10, ChunkSize: chunkSize, ChunkHashes: []string{"c", "d"}, Hash: "other"}
+	reloaded, fresh := loadState(outPath, different)
+	if !fresh {
+		t.Error("loadState should report fresh = true when the sidecar doesn't match the new manifest")
+	}
+	for i, have := range reloaded.Have {
+		if have {
+			t.Errorf("chunk %d carried over from a state for a different file", i)
+		}
+	}
+}